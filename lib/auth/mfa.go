@@ -0,0 +1,51 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/client/proto"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/auth/u2f"
+)
+
+// checkMFAAuthenticateResponse verifies a generic proto.MFAAuthenticateResponse
+// against user's registered devices, dispatching to the TOTP, U2F or
+// WebAuthn verifier depending on which oneof case the client filled in.
+// This is the counterpart, on the authentication side, of
+// changeUserSecondFactor's dispatch over proto.MFARegisterResponse on the
+// registration side.
+func (s *Server) checkMFAAuthenticateResponse(ctx context.Context, user string, resp *proto.MFAAuthenticateResponse) (*types.MFADevice, error) {
+	switch r := resp.GetResponse().(type) {
+	case *proto.MFAAuthenticateResponse_TOTP:
+		return s.checkOTP(user, r.TOTP.GetCode())
+
+	case *proto.MFAAuthenticateResponse_U2F:
+		return s.checkU2FSignResponseLimited(ctx, user, &u2f.AuthenticateChallengeResponse{
+			KeyHandle:     r.U2F.GetKeyHandle(),
+			SignatureData: r.U2F.GetSignature(),
+			ClientData:    r.U2F.GetClientData(),
+		})
+
+	case *proto.MFAAuthenticateResponse_Webauthn:
+		return s.checkWebauthnLoginResponse(ctx, user, r.Webauthn)
+
+	default:
+		return nil, trace.BadParameter("unsupported MFA authenticate response %T", resp.GetResponse())
+	}
+}
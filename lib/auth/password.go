@@ -19,8 +19,7 @@ import (
 	"crypto/subtle"
 	"net/mail"
 
-	"golang.org/x/crypto/bcrypt"
-
+	"github.com/duo-labs/webauthn/protocol"
 	"github.com/gravitational/trace"
 
 	"github.com/gravitational/teleport"
@@ -29,18 +28,15 @@ import (
 	"github.com/gravitational/teleport/api/types"
 	apievents "github.com/gravitational/teleport/api/types/events"
 	"github.com/gravitational/teleport/lib/auth/u2f"
+	wanlib "github.com/gravitational/teleport/lib/auth/webauthn"
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/utils"
 
-	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 )
 
-// This is bcrypt hash for password "barbaz".
-var fakePasswordHash = []byte(`$2a$10$Yy.e6BmS2SrGbBDsyDLVkOANZmvjjMR890nUGSXFJHBXWzxe7T44m`)
-
 // ChangePasswordWithTokenRequest defines a request to change user password
 // DELETE IN 9.0.0 along with changePasswordWithToken http endpoint
 // in favor of grpc ChangeUserAuthentication.
@@ -130,6 +126,18 @@ func (s *Server) ChangePassword(req services.ChangePasswordReq) error {
 	}
 
 	userID := req.User
+	// rememberDevice marks (userID, ClientIP, DeviceHash) as trusted once a
+	// full second factor check succeeds, so the next login from the same
+	// tuple can skip straight to checkPasswordWOToken.
+	rememberDevice := func(mfaErr error) error {
+		if mfaErr == nil && req.ClientIP != "" && req.DeviceHash != "" {
+			if err := s.RememberTrustedDevice(ctx, userID, req.ClientIP, req.DeviceHash); err != nil {
+				log.WithError(err).Warn("Failed to remember trusted device.")
+			}
+		}
+		return trace.Wrap(mfaErr)
+	}
+
 	fn := func() error {
 		secondFactor := authPreference.GetSecondFactor()
 		switch secondFactor {
@@ -139,30 +147,54 @@ func (s *Server) ChangePassword(req services.ChangePasswordReq) error {
 			_, err := s.checkPassword(userID, req.OldPassword, req.SecondFactorToken)
 			return trace.Wrap(err)
 		case constants.SecondFactorU2F:
+			if req.WebauthnSignResponse != nil {
+				_, err := s.checkWebauthnLoginResponse(ctx, userID, req.WebauthnSignResponse)
+				return trace.Wrap(err)
+			}
 			if req.U2FSignResponse == nil {
 				return trace.AccessDenied("missing U2F sign response")
 			}
 
-			_, err := s.CheckU2FSignResponse(ctx, userID, req.U2FSignResponse)
+			_, err := s.checkU2FSignResponseLimited(ctx, userID, req.U2FSignResponse)
 			return trace.Wrap(err)
 		case constants.SecondFactorOn:
+			if req.ClientIP != "" && req.DeviceHash != "" && s.IsTrustedClient(ctx, userID, req.ClientIP, req.DeviceHash) {
+				return s.checkPasswordWOToken(userID, req.OldPassword)
+			}
 			if req.SecondFactorToken != "" {
 				_, err := s.checkPassword(userID, req.OldPassword, req.SecondFactorToken)
-				return trace.Wrap(err)
+				return rememberDevice(err)
+			}
+			if req.WebauthnSignResponse != nil {
+				_, err := s.checkWebauthnLoginResponse(ctx, userID, req.WebauthnSignResponse)
+				return rememberDevice(err)
 			}
 			if req.U2FSignResponse != nil {
-				_, err := s.CheckU2FSignResponse(ctx, userID, req.U2FSignResponse)
-				return trace.Wrap(err)
+				_, err := s.checkU2FSignResponseLimited(ctx, userID, req.U2FSignResponse)
+				return rememberDevice(err)
+			}
+			if req.RecoveryCode != "" {
+				return trace.Wrap(s.checkRecoveryCodeAudited(ctx, userID, req.RecoveryCode))
 			}
 			return trace.AccessDenied("missing second factor authentication")
 		case constants.SecondFactorOptional:
+			if req.ClientIP != "" && req.DeviceHash != "" && s.IsTrustedClient(ctx, userID, req.ClientIP, req.DeviceHash) {
+				return s.checkPasswordWOToken(userID, req.OldPassword)
+			}
 			if req.SecondFactorToken != "" {
 				_, err := s.checkPassword(userID, req.OldPassword, req.SecondFactorToken)
-				return trace.Wrap(err)
+				return rememberDevice(err)
+			}
+			if req.WebauthnSignResponse != nil {
+				_, err := s.checkWebauthnLoginResponse(ctx, userID, req.WebauthnSignResponse)
+				return rememberDevice(err)
 			}
 			if req.U2FSignResponse != nil {
-				_, err := s.CheckU2FSignResponse(ctx, userID, req.U2FSignResponse)
-				return trace.Wrap(err)
+				_, err := s.checkU2FSignResponseLimited(ctx, userID, req.U2FSignResponse)
+				return rememberDevice(err)
+			}
+			if req.RecoveryCode != "" {
+				return trace.Wrap(s.checkRecoveryCodeAudited(ctx, userID, req.RecoveryCode))
 			}
 			// Check that a user has no MFA devices registered.
 			devs, err := s.Identity.GetMFADevices(ctx, userID, false)
@@ -206,32 +238,47 @@ func (s *Server) ChangePassword(req services.ChangePasswordReq) error {
 // used in case of SSH authentication, when token has been validated.
 func (s *Server) checkPasswordWOToken(user string, password []byte) error {
 	const errMsg = "invalid username or password"
+	ctx := context.TODO()
 
 	err := services.VerifyPassword(password)
 	if err != nil {
 		return trace.BadParameter(errMsg)
 	}
 
-	hash, err := s.GetPasswordHash(user)
-	if err != nil && !trace.IsNotFound(err) {
+	authPref, err := s.GetAuthPreference(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hasher, err := NewPasswordHasher(authPref)
+	if err != nil {
 		return trace.Wrap(err)
 	}
-	userFound := true
+
+	hash, err := s.GetPasswordHash(user)
 	if trace.IsNotFound(err) {
-		userFound = false
 		log.Debugf("Username %q not found, using fake hash to mitigate timing attacks.", user)
-		hash = fakePasswordHash
+		dummyVerify(hasher, password)
+		return trace.BadParameter(errMsg)
+	}
+	if err != nil {
+		return trace.Wrap(err)
 	}
 
-	if err = bcrypt.CompareHashAndPassword(hash, password); err != nil {
+	verifier, err := detectPasswordHasher(hash)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := verifier.Verify(hash, password); err != nil {
 		log.Debugf("Password for %q does not match", user)
 		return trace.BadParameter(errMsg)
 	}
 
-	// Careful! The bcrypt check above may succeed for an unknown user when the
-	// provided password is "barbaz", which is what fakePasswordHash hashes to.
-	if !userFound {
-		return trace.BadParameter(errMsg)
+	// Transparently rehash the stored hash if it was produced by a different
+	// algorithm than the cluster's current policy, or by weaker parameters.
+	if verifier.Algo() != hasher.Algo() || hasher.NeedsRehash(hash) {
+		if err := s.UpsertPassword(user, password); err != nil {
+			log.WithError(err).Warnf("Failed to rehash password for %q.", user)
+		}
 	}
 
 	return nil
@@ -255,9 +302,40 @@ func (s *Server) checkPassword(user string, password []byte, otpToken string) (*
 	return &checkPasswordResult{mfaDev: mfaDev}, nil
 }
 
+// checkU2FSignResponseLimited verifies a U2F sign response via
+// CheckU2FSignResponse, counting failures against the same per-user
+// sliding-window rate limit as checkOTP and checkWebauthnLoginResponse.
+func (s *Server) checkU2FSignResponseLimited(ctx context.Context, user string, resp *u2f.AuthenticateChallengeResponse) (*types.MFADevice, error) {
+	dev, err := s.CheckU2FSignResponse(ctx, user, resp)
+	if err != nil {
+		if globalSecondFactorFailureLimiter.recordFailure(user, s.clock.Now()) {
+			return nil, trace.AccessDenied("too many failed second factor attempts for %q, try again later", user)
+		}
+		return nil, trace.Wrap(err)
+	}
+	globalSecondFactorFailureLimiter.reset(user)
+	return dev, nil
+}
+
 // checkOTP determines the type of OTP token used (for legacy HOTP support), fetches the
-// appropriate type from the backend, and checks if the token is valid.
+// appropriate type from the backend, and checks if the token is valid. It
+// enforces a hard per-user sliding-window rate limit on failures, on top of
+// (and independent of) the backend-persisted lockout in WithUserLock.
 func (s *Server) checkOTP(user string, otpToken string) (*types.MFADevice, error) {
+	dev, err := s.checkOTPUnlimited(user, otpToken)
+	if err != nil {
+		if globalSecondFactorFailureLimiter.recordFailure(user, s.clock.Now()) {
+			return nil, trace.AccessDenied("too many failed second factor attempts for %q, try again later", user)
+		}
+		return nil, trace.Wrap(err)
+	}
+	globalSecondFactorFailureLimiter.reset(user)
+	return dev, nil
+}
+
+// checkOTPUnlimited is checkOTP without the failure rate limit, used
+// internally so the limiter only ever wraps a single call site.
+func (s *Server) checkOTPUnlimited(user string, otpToken string) (*types.MFADevice, error) {
 	var err error
 
 	otpType, err := s.getOTPType(user)
@@ -320,16 +398,17 @@ func (s *Server) checkOTP(user string, otpToken string) (*types.MFADevice, error
 
 // checkTOTP checks if the TOTP token is valid.
 func (s *Server) checkTOTP(ctx context.Context, user, otpToken string, dev *types.MFADevice) error {
-	if dev.GetTotp() == nil {
+	totpDev := dev.GetTotp()
+	if totpDev == nil {
 		return trace.BadParameter("checkTOTP called with non-TOTP MFADevice %T", dev.Device)
 	}
 	// we use totp.ValidateCustom over totp.Validate so we can use
 	// a fake clock in tests to get reliable results
-	valid, err := totp.ValidateCustom(otpToken, dev.GetTotp().Key, s.clock.Now(), totp.ValidateOpts{
-		Period:    teleport.TOTPValidityPeriod,
-		Skew:      teleport.TOTPSkew,
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA1,
+	valid, err := totp.ValidateCustom(otpToken, totpDev.Key, s.clock.Now(), totp.ValidateOpts{
+		Period:    totpPeriod(totpDev),
+		Skew:      totpSkew(totpDev),
+		Digits:    totpDigits(totpDev),
+		Algorithm: totpAlgorithm(totpDev),
 	})
 	if err != nil {
 		return trace.AccessDenied("failed to validate TOTP code: %v", err)
@@ -350,6 +429,84 @@ func (s *Server) checkTOTP(ctx context.Context, user, otpToken string, dev *type
 	return nil
 }
 
+// checkWebauthnLoginResponse verifies a WebAuthn assertion against the
+// user's registered devices. It also accepts assertions produced by legacy
+// U2F keys: those are translated via the U2F AppID extension before being
+// handed to the WebAuthn library, so existing security keys keep working
+// once a cluster switches its second factor to WebAuthn. Failures count
+// against the same per-user sliding-window rate limit as checkOTP and the
+// U2F check.
+func (s *Server) checkWebauthnLoginResponse(ctx context.Context, user string, resp *protocol.CredentialAssertionResponse) (*types.MFADevice, error) {
+	dev, err := s.checkWebauthnLoginResponseUnlimited(ctx, user, resp)
+	if err != nil {
+		if globalSecondFactorFailureLimiter.recordFailure(user, s.clock.Now()) {
+			return nil, trace.AccessDenied("too many failed second factor attempts for %q, try again later", user)
+		}
+		return nil, trace.Wrap(err)
+	}
+	globalSecondFactorFailureLimiter.reset(user)
+	return dev, nil
+}
+
+// checkWebauthnLoginResponseUnlimited is checkWebauthnLoginResponse without
+// the failure rate limit, used internally so the limiter only ever wraps a
+// single call site.
+func (s *Server) checkWebauthnLoginResponseUnlimited(ctx context.Context, user string, resp *protocol.CredentialAssertionResponse) (*types.MFADevice, error) {
+	cap, err := s.GetAuthPreference(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	webConfig, err := cap.GetWebauthn()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	parsedResp, err := wanlib.ParseCredentialAssertionResponse(resp, webConfig.AppID, webConfig.RPID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	u, err := s.GetUser(user, false)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	flow := &wanlib.LoginFlow{Webauthn: webConfig, Identity: s.Identity}
+	dev, err := flow.Finish(ctx, u, parsedResp)
+	if err != nil {
+		return nil, trace.AccessDenied("%v", err)
+	}
+	return dev, nil
+}
+
+// CreateSignupWebauthnRegisterRequest initiates WebAuthn registration for a
+// new device (Touch ID, Windows Hello, or a CTAP2 security key) during the
+// password reset / user invite flow.
+func (s *Server) CreateSignupWebauthnRegisterRequest(tokenID string) (*protocol.CredentialCreation, error) {
+	ctx := context.TODO()
+	cap, err := s.GetAuthPreference(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	webConfig, err := cap.GetWebauthn()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	token, err := s.getResetPasswordToken(ctx, tokenID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	user, err := s.GetUser(token.GetUser(), false)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	flow := &wanlib.RegistrationFlow{Webauthn: webConfig, Identity: s.Identity}
+	return flow.Begin(ctx, user)
+}
+
 // CreateSignupU2FRegisterRequest initiates registration for a new U2F token.
 // The returned challenge should be sent to the client to sign.
 func (s *Server) CreateSignupU2FRegisterRequest(tokenID string) (*u2f.RegisterChallenge, error) {
@@ -467,6 +624,17 @@ func (s *Server) changeUserSecondFactor(req *proto.ChangeUserAuthenticationReque
 		if err != nil {
 			return trace.Wrap(err)
 		}
+		// Thread the algorithm/digits/period/skew resolved at
+		// CreateTOTPRegistrationChallenge time through to the stored
+		// device, so a device enrolled with e.g. SHA256/8 digits is
+		// actually validated against those parameters afterwards instead
+		// of silently falling back to SHA1/6 digits.
+		if totpDev := dev.GetTotp(); totpDev != nil {
+			totpDev.Algorithm = secrets.GetTOTPAlgorithm()
+			totpDev.Digits = secrets.GetTOTPDigits()
+			totpDev.Period = secrets.GetTOTPPeriod()
+			totpDev.Skew = secrets.GetTOTPSkew()
+		}
 		if err := s.checkTOTP(ctx, username, req.GetNewMFARegisterResponse().GetTOTP().GetCode(), dev); err != nil {
 			return trace.Wrap(err)
 		}
@@ -498,6 +666,29 @@ func (s *Server) changeUserSecondFactor(req *proto.ChangeUserAuthenticationReque
 			AttestationCAs: cfg.DeviceAttestationCAs,
 		})
 		return trace.Wrap(err)
+
+	case *proto.MFARegisterResponse_Webauthn:
+		webConfig, err := cap.GetWebauthn()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		user, err := s.GetUser(username, false)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		parsedResp, err := protocol.ParseCredentialCreationResponseBody(req.GetNewMFARegisterResponse().GetWebauthn())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		flow := &wanlib.RegistrationFlow{Webauthn: webConfig, Identity: s.Identity}
+		if _, err := flow.Finish(ctx, user, "webauthn", parsedResp); err != nil {
+			return trace.Wrap(err)
+		}
+		return nil
+
 	default:
 		if secondFactor != constants.SecondFactorOptional {
 			return trace.BadParameter("no second factor sent during user %q password reset", username)
@@ -0,0 +1,373 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/services"
+)
+
+// passwordHashAlgo identifies one of the supported password hashing
+// algorithms. The value is stored as a prefix on the hash itself (in the
+// style of bcrypt's "$2a$" prefix) so an already-hashed password can always
+// be verified regardless of what the cluster's current policy is.
+type passwordHashAlgo string
+
+const (
+	passwordHashBcrypt   passwordHashAlgo = "bcrypt"
+	passwordHashArgon2id passwordHashAlgo = "argon2id"
+	passwordHashScrypt   passwordHashAlgo = "scrypt"
+)
+
+// argon2idPrefix/scryptPrefix mark hashes produced by this package so they
+// can be told apart from bcrypt's native "$2a$"/"$2b$" prefixes.
+const (
+	argon2idPrefix = "$argon2id$"
+	scryptPrefix   = "$scrypt$"
+)
+
+// PasswordHasher hashes and verifies user passwords. Implementations must
+// be safe to call concurrently and must not leak timing information about
+// whether a verification failed due to a bad password vs. an unknown user
+// (see dummyVerify).
+type PasswordHasher interface {
+	// Algo identifies the algorithm this hasher implements.
+	Algo() passwordHashAlgo
+	// Hash produces a new, self-describing hash of password using this
+	// hasher's currently configured cost parameters.
+	Hash(password []byte) ([]byte, error)
+	// Verify reports whether password matches hash. hash must have been
+	// produced by this hasher's Algo.
+	Verify(hash, password []byte) error
+	// NeedsRehash reports whether hash was produced with weaker parameters
+	// than this hasher's current policy and should be upgraded.
+	NeedsRehash(hash []byte) bool
+}
+
+// NewPasswordHasher builds the PasswordHasher for the given cluster auth
+// preference. Unset preferences default to argon2id, matching the module's
+// recommended default for new clusters; bcrypt and scrypt can be selected
+// explicitly.
+func NewPasswordHasher(authPref types.AuthPreference) (PasswordHasher, error) {
+	params := authPref.GetPasswordHashParams()
+	switch passwordHashAlgo(params.Algorithm) {
+	case "", passwordHashArgon2id:
+		return newArgon2idHasher(params), nil
+	case passwordHashBcrypt:
+		return bcryptHasher{cost: bcrypt.DefaultCost}, nil
+	case passwordHashScrypt:
+		return newScryptHasher(params), nil
+	default:
+		return nil, trace.BadParameter("unsupported password hash algorithm %q", params.Algorithm)
+	}
+}
+
+// UpsertPassword validates and hashes password using the cluster's
+// currently configured PasswordHasher, then stores the resulting hash for
+// user. This is the only path that should ever write a password hash,
+// including the rehash-on-login migration in checkPasswordWOToken, so that
+// a cluster that changes its password hashing policy actually migrates
+// users to it instead of leaving existing hashes on the old algorithm.
+func (s *Server) UpsertPassword(user string, password []byte) error {
+	if err := services.VerifyPassword(password); err != nil {
+		return trace.Wrap(err)
+	}
+
+	authPref, err := s.GetAuthPreference(context.TODO())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hasher, err := NewPasswordHasher(authPref)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(s.Identity.UpsertPassword(user, hash))
+}
+
+// bcryptHasher serves clusters whose auth preference selects bcrypt, and
+// verifies the bcrypt hashes of users whose passwords were stored before
+// argon2id became the default.
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Algo() passwordHashAlgo { return passwordHashBcrypt }
+
+func (h bcryptHasher) Hash(password []byte) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, h.cost)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return hash, nil
+}
+
+func (h bcryptHasher) Verify(hash, password []byte) error {
+	if err := bcrypt.CompareHashAndPassword(hash, password); err != nil {
+		return trace.AccessDenied("password does not match")
+	}
+	return nil
+}
+
+func (h bcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return true
+	}
+	return cost < h.cost
+}
+
+// fakeBcryptHash is the bcrypt hash of the password "barbaz", used to give
+// unknown-user logins a constant-time bcrypt comparison to perform.
+var fakeBcryptHash = []byte(`$2a$10$Yy.e6BmS2SrGbBDsyDLVkOANZmvjjMR890nUGSXFJHBXWzxe7T44m`)
+
+// fakeArgon2idHash and fakeScryptHash mirror fakeBcryptHash for the other
+// two algorithms. They are computed once at process start, not per request:
+// hashing "barbaz" fresh on every dummyVerify call would cost roughly twice
+// a real Verify (salt generation plus a second KDF pass), reopening the
+// timing side channel dummyVerify exists to close.
+var (
+	fakeArgon2idHash []byte
+	fakeScryptHash   []byte
+)
+
+func init() {
+	var err error
+	fakeArgon2idHash, err = newArgon2idHasher(types.PasswordHashParams{}).Hash([]byte("barbaz"))
+	if err != nil {
+		panic(err)
+	}
+	fakeScryptHash, err = newScryptHasher(types.PasswordHashParams{}).Hash([]byte("barbaz"))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// argon2idHasher implements PasswordHasher using argon2id, the module's
+// recommended default algorithm for new password hashes.
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+	saltLen uint32
+}
+
+func newArgon2idHasher(params types.PasswordHashParams) argon2idHasher {
+	h := argon2idHasher{
+		time:    params.Argon2Time,
+		memory:  params.Argon2MemoryKiB,
+		threads: uint8(params.Argon2Parallelism),
+		keyLen:  32,
+		saltLen: 16,
+	}
+	if h.time == 0 {
+		h.time = 3
+	}
+	if h.memory == 0 {
+		h.memory = 64 * 1024 // 64 MiB
+	}
+	if h.threads == 0 {
+		h.threads = 4
+	}
+	return h
+}
+
+func (h argon2idHasher) Algo() passwordHashAlgo { return passwordHashArgon2id }
+
+func (h argon2idHasher) Hash(password []byte) ([]byte, error) {
+	salt, err := randomBytes(int(h.saltLen))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sum := argon2.IDKey(password, salt, h.time, h.memory, h.threads, h.keyLen)
+	return []byte(fmt.Sprintf("%sv=19$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, h.memory, h.time, h.threads, b64(salt), b64(sum))), nil
+}
+
+func (h argon2idHasher) Verify(hash, password []byte) error {
+	memory, time, threads, salt, sum, err := parseArgon2idHash(hash)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	candidate := argon2.IDKey(password, salt, time, memory, threads, uint32(len(sum)))
+	if subtle.ConstantTimeCompare(candidate, sum) != 1 {
+		return trace.AccessDenied("password does not match")
+	}
+	return nil
+}
+
+func (h argon2idHasher) NeedsRehash(hash []byte) bool {
+	memory, time, threads, _, _, err := parseArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return memory < h.memory || time < h.time || threads < h.threads
+}
+
+// scryptHasher implements PasswordHasher using scrypt, offered as an
+// alternative for deployments that already standardize on it elsewhere.
+type scryptHasher struct {
+	n, r, p int
+	keyLen  int
+	saltLen int
+}
+
+func newScryptHasher(params types.PasswordHashParams) scryptHasher {
+	h := scryptHasher{n: 1 << 15, r: 8, p: 1, keyLen: 32, saltLen: 16}
+	if params.ScryptN != 0 {
+		h.n = int(params.ScryptN)
+	}
+	return h
+}
+
+func (h scryptHasher) Algo() passwordHashAlgo { return passwordHashScrypt }
+
+func (h scryptHasher) Hash(password []byte) ([]byte, error) {
+	salt, err := randomBytes(h.saltLen)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sum, err := scrypt.Key(password, salt, h.n, h.r, h.p, h.keyLen)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return []byte(fmt.Sprintf("%sn=%d,r=%d,p=%d$%s$%s", scryptPrefix, h.n, h.r, h.p, b64(salt), b64(sum))), nil
+}
+
+func (h scryptHasher) Verify(hash, password []byte) error {
+	n, r, p, salt, sum, err := parseScryptHash(hash)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	candidate, err := scrypt.Key(password, salt, n, r, p, len(sum))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if subtle.ConstantTimeCompare(candidate, sum) != 1 {
+		return trace.AccessDenied("password does not match")
+	}
+	return nil
+}
+
+func (h scryptHasher) NeedsRehash(hash []byte) bool {
+	n, _, _, _, _, err := parseScryptHash(hash)
+	if err != nil {
+		return true
+	}
+	return n < h.n
+}
+
+// detectPasswordHasher returns the PasswordHasher capable of verifying hash,
+// identified by its self-describing prefix.
+func detectPasswordHasher(hash []byte) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(string(hash), argon2idPrefix):
+		return newArgon2idHasher(types.PasswordHashParams{}), nil
+	case strings.HasPrefix(string(hash), scryptPrefix):
+		return newScryptHasher(types.PasswordHashParams{}), nil
+	case strings.HasPrefix(string(hash), "$2a$"), strings.HasPrefix(string(hash), "$2b$"), strings.HasPrefix(string(hash), "$2y$"):
+		return bcryptHasher{cost: bcrypt.DefaultCost}, nil
+	default:
+		return nil, trace.BadParameter("unrecognized password hash format")
+	}
+}
+
+// dummyVerify runs a full Verify call against a fixed, fake hash so that
+// rejecting an unknown username takes the same time as rejecting a known
+// user's wrong password, regardless of which algorithm is configured.
+func dummyVerify(hasher PasswordHasher, password []byte) {
+	switch hasher.Algo() {
+	case passwordHashArgon2id:
+		newArgon2idHasher(types.PasswordHashParams{}).Verify(fakeArgon2idHash, password) //nolint:errcheck
+	case passwordHashScrypt:
+		newScryptHasher(types.PasswordHashParams{}).Verify(fakeScryptHash, password) //nolint:errcheck
+	default:
+		bcryptHasher{cost: bcrypt.DefaultCost}.Verify(fakeBcryptHash, password) //nolint:errcheck
+	}
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return b, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func parseArgon2idHash(hash []byte) (memory, time uint32, threads uint8, salt, sum []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(string(hash), argon2idPrefix), "$")
+	if len(parts) != 4 {
+		return 0, 0, 0, nil, nil, trace.BadParameter("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	var m, t, p uint32
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	sum, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	return m, t, uint8(p), salt, sum, nil
+}
+
+func parseScryptHash(hash []byte) (n, r, p int, salt, sum []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(string(hash), scryptPrefix), "$")
+	if len(parts) != 3 {
+		return 0, 0, 0, nil, nil, trace.BadParameter("malformed scrypt hash")
+	}
+	if _, err := fmt.Sscanf(parts[0], "n=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	sum, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, 0, 0, nil, nil, trace.Wrap(err)
+	}
+	return n, r, p, salt, sum, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"bcrypt":   bcryptHasher{cost: bcrypt.MinCost},
+		"argon2id": newArgon2idHasher(types.PasswordHashParams{}),
+		"scrypt":   newScryptHasher(types.PasswordHashParams{}),
+	}
+
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			hash, err := hasher.Hash([]byte("correct-horse-battery-staple"))
+			require.NoError(t, err)
+
+			require.NoError(t, hasher.Verify(hash, []byte("correct-horse-battery-staple")))
+			require.Error(t, hasher.Verify(hash, []byte("wrong-password")))
+		})
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	weak := newArgon2idHasher(types.PasswordHashParams{Argon2Time: 1, Argon2MemoryKiB: 8 * 1024, Argon2Parallelism: 1})
+	hash, err := weak.Hash([]byte("password"))
+	require.NoError(t, err)
+	require.False(t, weak.NeedsRehash(hash))
+
+	stronger := newArgon2idHasher(types.PasswordHashParams{Argon2Time: 3, Argon2MemoryKiB: 64 * 1024, Argon2Parallelism: 4})
+	require.True(t, stronger.NeedsRehash(hash))
+}
+
+func TestScryptNeedsRehash(t *testing.T) {
+	weak := newScryptHasher(types.PasswordHashParams{ScryptN: 1 << 12})
+	hash, err := weak.Hash([]byte("password"))
+	require.NoError(t, err)
+	require.False(t, weak.NeedsRehash(hash))
+
+	stronger := newScryptHasher(types.PasswordHashParams{ScryptN: 1 << 16})
+	require.True(t, stronger.NeedsRehash(hash))
+}
+
+func TestDetectPasswordHasher(t *testing.T) {
+	for name, hasher := range map[string]PasswordHasher{
+		"bcrypt":   bcryptHasher{cost: bcrypt.MinCost},
+		"argon2id": newArgon2idHasher(types.PasswordHashParams{}),
+		"scrypt":   newScryptHasher(types.PasswordHashParams{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			hash, err := hasher.Hash([]byte("password"))
+			require.NoError(t, err)
+
+			detected, err := detectPasswordHasher(hash)
+			require.NoError(t, err)
+			require.Equal(t, hasher.Algo(), detected.Algo())
+		})
+	}
+
+	_, err := detectPasswordHasher([]byte("not-a-recognized-hash"))
+	require.Error(t, err)
+}
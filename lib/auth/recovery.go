@@ -0,0 +1,137 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// AuthenticateWithRecoveryCode verifies a single-use backup recovery code
+// previously issued to user and, on success, marks it as used so it cannot
+// be replayed. It is the recovery-code analog of checkPassword/checkOTP,
+// used when a user has lost access to their authenticator but still knows
+// their password.
+func (s *Server) AuthenticateWithRecoveryCode(ctx context.Context, user, code string) error {
+	fn := func() error {
+		return s.checkRecoveryCodeAudited(ctx, user, code)
+	}
+
+	return trace.Wrap(s.WithUserLock(user, fn))
+}
+
+// checkRecoveryCodeAudited wraps checkRecoveryCode with
+// emitRecoveryCodeAuthEvent, so every call site that accepts a recovery
+// code as one of several second factor options (ChangePassword,
+// checkSecondFactorForSignin) reaches the audit trail too, not just
+// AuthenticateWithRecoveryCode's own direct callers.
+func (s *Server) checkRecoveryCodeAudited(ctx context.Context, user, code string) error {
+	err := s.checkRecoveryCode(ctx, user, code)
+	s.emitRecoveryCodeAuthEvent(ctx, user, err)
+	return err
+}
+
+// recoveryCodeMu serializes checkRecoveryCode's read-modify-write of a
+// user's recovery codes. Without it, two concurrent requests presenting the
+// same valid code can both pass the unused-code scan before either call
+// reaches UpsertRecoveryCodes, defeating the single-use guarantee. Recovery
+// code checks are rare enough that a single process-wide lock, rather than
+// a per-user one, is not worth the extra bookkeeping.
+var recoveryCodeMu sync.Mutex
+
+// checkRecoveryCode hashes code and constant-time-compares it against every
+// unused recovery code hash stored for user, marking the first match as
+// used. Recovery codes are single-use: once consumed, the same code cannot
+// authenticate a second time.
+func (s *Server) checkRecoveryCode(ctx context.Context, user, code string) error {
+	const errMsg = "invalid recovery code"
+
+	recoveryCodeMu.Lock()
+	defer recoveryCodeMu.Unlock()
+
+	codes, err := s.Identity.GetRecoveryCodes(ctx, user, true /* withSecrets */)
+	if err != nil {
+		if trace.IsNotFound(err) {
+			// Do the bcrypt comparison anyway so a user with no recovery
+			// codes takes the same time to reject as one with a wrong code.
+			bcrypt.CompareHashAndPassword(fakeBcryptHash, []byte(code)) //nolint:errcheck
+			return trace.AccessDenied(errMsg)
+		}
+		return trace.Wrap(err)
+	}
+
+	matchedIndex := matchRecoveryCode(codes.GetCodes(), code)
+	if matchedIndex == -1 {
+		return trace.AccessDenied(errMsg)
+	}
+
+	codes.GetCodes()[matchedIndex].IsUsed = true
+	if err := s.Identity.UpsertRecoveryCodes(ctx, user, codes); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// matchRecoveryCode returns the index of the first unused code in codes
+// whose hash matches code, or -1 if none match. It runs a dummy comparison
+// against every already-used code along the way, so whether a code was
+// accepted, rejected, or already consumed can't be told apart by timing.
+func matchRecoveryCode(codes []*types.RecoveryCode, code string) int {
+	matchedIndex := -1
+	for i, rc := range codes {
+		if rc.IsUsed {
+			bcrypt.CompareHashAndPassword(fakeBcryptHash, []byte(code)) //nolint:errcheck
+			continue
+		}
+		if err := bcrypt.CompareHashAndPassword(rc.HashedCode, []byte(code)); err == nil && matchedIndex == -1 {
+			matchedIndex = i
+		}
+	}
+	return matchedIndex
+}
+
+// emitRecoveryCodeAuthEvent records a RecoveryCodeUsed audit event, distinct
+// from UserPasswordChangeEvent, so recovery-code usage shows up on its own
+// in the audit log regardless of whether the subsequent credential change
+// succeeds.
+func (s *Server) emitRecoveryCodeAuthEvent(ctx context.Context, user string, authErr error) {
+	event := &apievents.RecoveryCodeUsed{
+		Metadata: apievents.Metadata{
+			Type: events.RecoveryCodeUsedEvent,
+			Code: events.RecoveryCodeUsedSuccessCode,
+		},
+		UserMetadata: apievents.UserMetadata{
+			User: user,
+		},
+		Status: apievents.Status{
+			Success: authErr == nil,
+		},
+	}
+	if authErr != nil {
+		event.Metadata.Code = events.RecoveryCodeUsedFailureCode
+		event.Status.Error = authErr.Error()
+	}
+	if err := s.emitter.EmitAuditEvent(s.closeCtx, event); err != nil {
+		log.WithError(err).Warn("Failed to emit recovery code authentication event.")
+	}
+}
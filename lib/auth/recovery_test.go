@@ -0,0 +1,44 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+func hashRecoveryCode(t *testing.T, code string) []byte {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.MinCost)
+	require.NoError(t, err)
+	return hash
+}
+
+func TestMatchRecoveryCode(t *testing.T) {
+	codes := []*types.RecoveryCode{
+		{HashedCode: hashRecoveryCode(t, "code-one"), IsUsed: true},
+		{HashedCode: hashRecoveryCode(t, "code-two"), IsUsed: false},
+		{HashedCode: hashRecoveryCode(t, "code-three"), IsUsed: false},
+	}
+
+	require.Equal(t, 1, matchRecoveryCode(codes, "code-two"))
+	require.Equal(t, 2, matchRecoveryCode(codes, "code-three"))
+	require.Equal(t, -1, matchRecoveryCode(codes, "code-one"), "an already-used code must not match again")
+	require.Equal(t, -1, matchRecoveryCode(codes, "not-a-real-code"))
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/client/proto"
+	"github.com/gravitational/teleport/api/constants"
+	"github.com/gravitational/teleport/api/types"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// defaultSigninTokenTTL bounds how long an unredeemed magic-link stays
+// valid if the caller does not request a shorter one.
+const defaultSigninTokenTTL = 15 * time.Minute
+
+// CreateSigninToken mints a short-lived, single-use sign-in ("magic-link")
+// token for username and returns it so the caller can email a link of the
+// form https://proxy/web/signin/<token.GetName()>. The token carries no
+// secrets of its own beyond its ID and is redeemed via
+// AuthenticateWithSigninToken.
+func (s *Server) CreateSigninToken(ctx context.Context, username string, ttl time.Duration) (types.UserToken, error) {
+	if _, err := s.GetUser(username, false); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if ttl <= 0 {
+		ttl = defaultSigninTokenTTL
+	}
+
+	token, err := s.newUserToken(newUserTokenRequest{
+		name: username,
+		ttl:  ttl,
+		typ:  types.UserTokenTypeSignin,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if _, err := s.Identity.CreateUserToken(ctx, token); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := s.emitter.EmitAuditEvent(s.closeCtx, &apievents.UserTokenCreate{
+		Metadata: apievents.Metadata{
+			Type: events.UserTokenCreateEvent,
+			Code: events.SigninTokenCreateCode,
+		},
+		UserMetadata: apievents.UserMetadata{
+			User: username,
+		},
+	}); err != nil {
+		log.WithError(err).Warn("Failed to emit signin token create event.")
+	}
+
+	return token, nil
+}
+
+// AuthenticateWithSigninToken redeems a sign-in token minted by
+// CreateSigninToken, gating the exchange behind the same second factor
+// checks ChangePassword enforces whenever the cluster's SecondFactor is not
+// Off, and returns a new web session on success. The token is single-use:
+// it is deleted whether or not the exchange succeeds.
+func (s *Server) AuthenticateWithSigninToken(ctx context.Context, req *signinTokenAuthRequest) (*types.WebSessionV2, error) {
+	token, err := s.Identity.GetUserToken(ctx, req.TokenID)
+	if err != nil {
+		return nil, trace.AccessDenied("invalid or expired signin token")
+	}
+	defer s.Identity.DeleteUserToken(ctx, req.TokenID) //nolint:errcheck
+
+	if token.GetSubKind() != types.UserTokenTypeSignin {
+		return nil, trace.AccessDenied("invalid or expired signin token")
+	}
+	if token.Expiry().Before(s.clock.Now().UTC()) {
+		return nil, trace.AccessDenied("invalid or expired signin token")
+	}
+
+	username := token.GetUser()
+	if err := s.WithUserLock(username, func() error {
+		return s.checkSecondFactorForSignin(ctx, username, req)
+	}); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	user, err := s.GetUser(username, false)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	webSession, err := s.createUserWebSession(ctx, user)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sess, ok := webSession.(*types.WebSessionV2)
+	if !ok {
+		return nil, trace.BadParameter("unexpected WebSessionV2 type %T", webSession)
+	}
+
+	if err := s.emitter.EmitAuditEvent(s.closeCtx, &apievents.UserLogin{
+		Metadata: apievents.Metadata{
+			Type: events.UserLoginEvent,
+			Code: events.SigninTokenRedeemedCode,
+		},
+		UserMetadata: apievents.UserMetadata{
+			User: username,
+		},
+		Method: events.LoginMethodSigninToken,
+	}); err != nil {
+		log.WithError(err).Warn("Failed to emit signin token redeemed event.")
+	}
+
+	return sess, nil
+}
+
+// signinTokenAuthRequest carries the second factor response presented
+// alongside a signin token. MFAResponse covers the TOTP/U2F/WebAuthn cases
+// through the same generic proto path checkMFAAuthenticateResponse uses;
+// RecoveryCode is handled separately, as it is in ChangePassword.
+type signinTokenAuthRequest struct {
+	TokenID      string
+	MFAResponse  *proto.MFAAuthenticateResponse
+	RecoveryCode string
+}
+
+// checkSecondFactorForSignin applies the same OTP/U2F/WebAuthn/recovery-code
+// gate ChangePassword uses, so a sign-in link can't be redeemed for a user
+// with MFA configured unless a valid second factor is also presented. As in
+// ChangePassword's SecondFactorOptional case, a user with no MFA devices
+// registered is let through without one. Callers must run this under
+// s.WithUserLock so repeated failures are locked out like every other
+// credential check in this package.
+func (s *Server) checkSecondFactorForSignin(ctx context.Context, username string, req *signinTokenAuthRequest) error {
+	authPreference, err := s.GetAuthPreference(ctx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	switch authPreference.GetSecondFactor() {
+	case constants.SecondFactorOff:
+		return nil
+	default:
+		if req.MFAResponse != nil {
+			_, err := s.checkMFAAuthenticateResponse(ctx, username, req.MFAResponse)
+			return trace.Wrap(err)
+		}
+		if req.RecoveryCode != "" {
+			return trace.Wrap(s.checkRecoveryCodeAudited(ctx, username, req.RecoveryCode))
+		}
+
+		devs, err := s.Identity.GetMFADevices(ctx, username, false)
+		if err != nil && !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		if !allowNoSecondFactor(authPreference.GetSecondFactor(), len(devs)) {
+			log.Warningf("MFA bypass attempt by user %q against signin token, access denied.", username)
+			return trace.AccessDenied("missing second factor authentication")
+		}
+		return nil
+	}
+}
+
+// allowNoSecondFactor reports whether a user with numDevices registered MFA
+// devices may redeem a signin token (or change their password) without
+// presenting one, matching ChangePassword's SecondFactorOptional case: a
+// user who never enrolled MFA on an Optional cluster isn't locked out of
+// their account for lacking something they were never required to set up.
+func allowNoSecondFactor(secondFactor constants.SecondFactor, numDevices int) bool {
+	return secondFactor == constants.SecondFactorOptional && numDevices == 0
+}
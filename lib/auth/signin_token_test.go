@@ -0,0 +1,57 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/api/constants"
+)
+
+func TestAllowNoSecondFactor(t *testing.T) {
+	tests := []struct {
+		name         string
+		secondFactor constants.SecondFactor
+		numDevices   int
+		want         bool
+	}{
+		{
+			name:         "optional with no enrolled devices is let through",
+			secondFactor: constants.SecondFactorOptional,
+			numDevices:   0,
+			want:         true,
+		},
+		{
+			name:         "optional with an enrolled device still requires it",
+			secondFactor: constants.SecondFactorOptional,
+			numDevices:   1,
+			want:         false,
+		},
+		{
+			name:         "on always requires a second factor",
+			secondFactor: constants.SecondFactorOn,
+			numDevices:   0,
+			want:         false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, allowNoSecondFactor(tt.secondFactor, tt.numDevices))
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/skip2/go-qrcode"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/api/types"
+)
+
+// totpPeriod returns dev's configured validity period, falling back to the
+// cluster default for devices enrolled before per-device periods existed.
+func totpPeriod(dev *types.TOTPDevice) uint {
+	if dev.Period != 0 {
+		return dev.Period
+	}
+	return teleport.TOTPValidityPeriod
+}
+
+// totpSkew returns dev's configured skew, falling back to the cluster
+// default for devices enrolled before per-device skew existed.
+func totpSkew(dev *types.TOTPDevice) uint {
+	if dev.Skew != 0 {
+		return dev.Skew
+	}
+	return teleport.TOTPSkew
+}
+
+// totpDigits returns dev's configured digit count, defaulting to 6 for
+// devices enrolled before this was configurable.
+func totpDigits(dev *types.TOTPDevice) otp.Digits {
+	switch dev.Digits {
+	case 8:
+		return otp.DigitsEight
+	default:
+		return otp.DigitsSix
+	}
+}
+
+// totpAlgorithm returns dev's configured HMAC algorithm, defaulting to
+// SHA1 for devices enrolled before this was configurable.
+func totpAlgorithm(dev *types.TOTPDevice) otp.Algorithm {
+	switch dev.Algorithm {
+	case "SHA256":
+		return otp.AlgorithmSHA256
+	case "SHA512":
+		return otp.AlgorithmSHA512
+	default:
+		return otp.AlgorithmSHA1
+	}
+}
+
+// TOTPRegistrationChallenge is the client-facing response to
+// CreateTOTPRegistrationChallenge: everything needed to render a QR code
+// and display the algorithm parameters an authenticator app will use.
+type TOTPRegistrationChallenge struct {
+	// OTPAuthURL is the otpauth:// URL encoding the shared secret and
+	// parameters, suitable for a "can't scan the code" manual entry link.
+	OTPAuthURL string
+	// QRCodePNG is a rendered PNG QR code of OTPAuthURL.
+	QRCodePNG []byte
+	// Algorithm, Digits, Period and Skew are the parameters that will be
+	// enforced on this device once registered.
+	Algorithm string
+	Digits    uint
+	Period    uint
+	Skew      uint
+}
+
+// TOTPRegistrationOpts selects the TOTP parameters for a new device,
+// constrained by the cluster's auth preference.
+type TOTPRegistrationOpts struct {
+	// Algorithm is one of "SHA1" (default), "SHA256", or "SHA512".
+	Algorithm string
+	// Digits is 6 (default) or 8.
+	Digits uint
+	// Period is the validity period in seconds, defaulting to
+	// teleport.TOTPValidityPeriod when unset.
+	Period uint
+	// Skew is the number of periods of clock drift to tolerate, defaulting
+	// to teleport.TOTPSkew when unset.
+	Skew uint
+}
+
+// CreateTOTPRegistrationChallenge generates a new TOTP shared secret for the
+// reset/invite token tokenID and returns the otpauth:// URL, a rendered QR
+// code, and the algorithm parameters the client should display, honoring
+// opts and the cluster's allowed algorithms / minimum digit count.
+func (s *Server) CreateTOTPRegistrationChallenge(ctx context.Context, tokenID string, opts TOTPRegistrationOpts) (*TOTPRegistrationChallenge, error) {
+	token, err := s.getResetPasswordToken(ctx, tokenID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	cap, err := s.GetAuthPreference(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	totpConfig, err := cap.GetTOTP()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	algorithm, digits, period, skew, err := resolveTOTPParams(totpConfig, opts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	clusterName, err := s.GetClusterName()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	otpKey, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      clusterName.GetClusterName(),
+		AccountName: token.GetUser(),
+		Algorithm:   totpAlgorithmFromName(algorithm),
+		Digits:      totpDigitsFromCount(digits),
+		Period:      period,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	secrets, err := types.NewUserTokenSecrets(tokenID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	secrets.SetOTPKey(otpKey.Secret())
+	secrets.SetQRCode([]byte(otpKey.String()))
+	secrets.SetTOTPAlgorithm(algorithm)
+	secrets.SetTOTPDigits(digits)
+	secrets.SetTOTPPeriod(period)
+	secrets.SetTOTPSkew(skew)
+	if err := s.Identity.UpsertUserTokenSecrets(ctx, secrets); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	qrPNG, err := renderQRCode(otpKey.String())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &TOTPRegistrationChallenge{
+		OTPAuthURL: otpKey.String(),
+		QRCodePNG:  qrPNG,
+		Algorithm:  algorithm,
+		Digits:     digits,
+		Period:     period,
+		Skew:       skew,
+	}, nil
+}
+
+// resolveTOTPParams validates the requested algorithm/digits against the
+// cluster's auth preference, applying defaults when opts leaves fields
+// unset, and returns the resolved period/skew alongside them so the caller
+// can persist all four onto the registration token's secrets.
+func resolveTOTPParams(cfg types.TOTPParams, opts TOTPRegistrationOpts) (algorithm string, digits, period, skew uint, err error) {
+	algorithm = opts.Algorithm
+	if algorithm == "" {
+		algorithm = "SHA1"
+	}
+	if len(cfg.AllowedAlgorithms) > 0 && !stringInSlice(cfg.AllowedAlgorithms, algorithm) {
+		return "", 0, 0, 0, trace.BadParameter("TOTP algorithm %q is not allowed by cluster auth preference", algorithm)
+	}
+
+	digits = opts.Digits
+	if digits == 0 {
+		digits = 6
+	}
+	if cfg.MinDigits != 0 && digits < cfg.MinDigits {
+		return "", 0, 0, 0, trace.BadParameter("TOTP digit count %d is below the cluster minimum of %d", digits, cfg.MinDigits)
+	}
+
+	period = opts.Period
+	if period == 0 {
+		period = teleport.TOTPValidityPeriod
+	}
+	skew = opts.Skew
+	if skew == 0 {
+		skew = teleport.TOTPSkew
+	}
+
+	return algorithm, digits, period, skew, nil
+}
+
+func stringInSlice(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func totpAlgorithmFromName(name string) otp.Algorithm {
+	switch name {
+	case "SHA256":
+		return otp.AlgorithmSHA256
+	case "SHA512":
+		return otp.AlgorithmSHA512
+	default:
+		return otp.AlgorithmSHA1
+	}
+}
+
+func totpDigitsFromCount(n uint) otp.Digits {
+	if n == 8 {
+		return otp.DigitsEight
+	}
+	return otp.DigitsSix
+}
+
+// renderQRCode encodes url as a PNG QR code suitable for display during
+// device enrollment.
+func renderQRCode(url string) ([]byte, error) {
+	qr, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, qr.Image(256)); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/api/types"
+)
+
+func TestResolveTOTPParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        types.TOTPParams
+		opts       TOTPRegistrationOpts
+		wantAlgo   string
+		wantDigits uint
+		wantPeriod uint
+		wantSkew   uint
+		wantErr    bool
+	}{
+		{
+			name:       "defaults when opts is empty",
+			wantAlgo:   "SHA1",
+			wantDigits: 6,
+			wantPeriod: teleport.TOTPValidityPeriod,
+			wantSkew:   teleport.TOTPSkew,
+		},
+		{
+			name:       "explicit params are preserved",
+			opts:       TOTPRegistrationOpts{Algorithm: "SHA256", Digits: 8, Period: 60, Skew: 2},
+			wantAlgo:   "SHA256",
+			wantDigits: 8,
+			wantPeriod: 60,
+			wantSkew:   2,
+		},
+		{
+			name:    "algorithm not allowed by cluster policy",
+			cfg:     types.TOTPParams{AllowedAlgorithms: []string{"SHA1"}},
+			opts:    TOTPRegistrationOpts{Algorithm: "SHA512"},
+			wantErr: true,
+		},
+		{
+			name:    "digits below cluster minimum",
+			cfg:     types.TOTPParams{MinDigits: 8},
+			opts:    TOTPRegistrationOpts{Digits: 6},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algorithm, digits, period, skew, err := resolveTOTPParams(tt.cfg, tt.opts)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAlgo, algorithm)
+			require.Equal(t, tt.wantDigits, digits)
+			require.Equal(t, tt.wantPeriod, period)
+			require.Equal(t, tt.wantSkew, skew)
+		})
+	}
+}
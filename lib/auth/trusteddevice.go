@@ -0,0 +1,147 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// trustedDeviceTTL is how long a successful MFA check is remembered for a
+// given (user, IP, device) tuple before it must be repeated.
+const trustedDeviceTTL = 30 * 24 * time.Hour
+
+// IsTrustedClient reports whether user has already completed a second
+// factor check from this exact IP and device fingerprint within
+// trustedDeviceTTL. When true, ChangePassword's SecondFactorOn/Optional
+// branches may accept the password alone and skip the MFA prompt.
+func (s *Server) IsTrustedClient(ctx context.Context, user, ip, deviceHash string) bool {
+	dev, err := s.Identity.GetTrustedDevice(ctx, user, deviceHash)
+	if err != nil {
+		return false
+	}
+	if dev.Expiry().Before(s.clock.Now()) {
+		return false
+	}
+	_, ipNet, err := net.ParseCIDR(dev.GetIPCIDR())
+	if err != nil {
+		return false
+	}
+	parsedIP := net.ParseIP(ip)
+	return parsedIP != nil && ipNet.Contains(parsedIP)
+}
+
+// RememberTrustedDevice records that user has just completed a second
+// factor check from ip/deviceHash, so subsequent password-only logins from
+// the same tuple are allowed to skip MFA until the entry expires.
+func (s *Server) RememberTrustedDevice(ctx context.Context, user, ip, deviceHash string) error {
+	cidr := ip + "/32"
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		cidr = ip + "/128"
+	}
+
+	dev, err := types.NewTrustedDevice(user, deviceHash, cidr, s.clock.Now().Add(trustedDeviceTTL))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := s.Identity.UpsertTrustedDevice(ctx, dev); err != nil {
+		return trace.Wrap(err)
+	}
+
+	s.emitTrustedDeviceEvent(ctx, user, deviceHash, true /* granted */)
+	return nil
+}
+
+// RevokeTrustedDevice forgets a previously remembered device, forcing the
+// next login from it to go through full second factor again.
+func (s *Server) RevokeTrustedDevice(ctx context.Context, user, deviceHash string) error {
+	if err := s.Identity.DeleteTrustedDevice(ctx, user, deviceHash); err != nil {
+		return trace.Wrap(err)
+	}
+	s.emitTrustedDeviceEvent(ctx, user, deviceHash, false /* granted */)
+	return nil
+}
+
+func (s *Server) emitTrustedDeviceEvent(ctx context.Context, user, deviceHash string, granted bool) {
+	event := &apievents.TrustedDeviceUpdate{
+		Metadata: apievents.Metadata{
+			Type: events.TrustedDeviceUpdateEvent,
+			Code: events.TrustedDeviceGrantedCode,
+		},
+		UserMetadata: apievents.UserMetadata{
+			User: user,
+		},
+		DeviceHash: deviceHash,
+	}
+	if !granted {
+		event.Metadata.Code = events.TrustedDeviceRevokedCode
+	}
+	if err := s.emitter.EmitAuditEvent(s.closeCtx, event); err != nil {
+		log.WithError(err).Warn("Failed to emit trusted device event.")
+	}
+}
+
+// secondFactorFailureLimiter enforces a hard per-user sliding-window limit
+// on failed second factor checks (TOTP, U2F, and WebAuthn alike), wrapped
+// around checkOTP, the U2F check, and checkWebauthnLoginResponse, and is
+// independent of WithUserLock's lockout. It is process-local and intentionally simple: a determined
+// attacker distributed across auth servers is still caught by WithUserLock's
+// backend-persisted lockout.
+type secondFactorFailureLimiter struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+var globalSecondFactorFailureLimiter = &secondFactorFailureLimiter{failures: make(map[string][]time.Time)}
+
+const (
+	secondFactorFailureLimit  = 5
+	secondFactorFailureWindow = 30 * time.Second
+)
+
+// recordFailure appends a failure timestamp for user and reports whether
+// the user has now reached secondFactorFailureLimit failures within
+// secondFactorFailureWindow.
+func (l *secondFactorFailureLimiter) recordFailure(user string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-secondFactorFailureWindow)
+	kept := l.failures[user][:0]
+	for _, t := range l.failures[user] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+	l.failures[user] = kept
+
+	return len(kept) >= secondFactorFailureLimit
+}
+
+// reset clears recorded failures for user, called after a successful check.
+func (l *secondFactorFailureLimiter) reset(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, user)
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondFactorFailureLimiterSlidingWindow(t *testing.T) {
+	limiter := &secondFactorFailureLimiter{failures: make(map[string][]time.Time)}
+	now := time.Now()
+
+	for i := 0; i < secondFactorFailureLimit-1; i++ {
+		require.False(t, limiter.recordFailure("alice", now))
+	}
+	require.True(t, limiter.recordFailure("alice", now), "limit-th failure should trip the limiter")
+
+	// Failures that age out of the window are evicted, so a user who
+	// stops failing for longer than the window isn't penalized forever.
+	later := now.Add(secondFactorFailureWindow + time.Second)
+	for i := 0; i < secondFactorFailureLimit-1; i++ {
+		require.False(t, limiter.recordFailure("alice", later))
+	}
+
+	// Other users have an independent window.
+	require.False(t, limiter.recordFailure("bob", now))
+}
+
+func TestSecondFactorFailureLimiterReset(t *testing.T) {
+	limiter := &secondFactorFailureLimiter{failures: make(map[string][]time.Time)}
+	now := time.Now()
+
+	for i := 0; i < secondFactorFailureLimit-1; i++ {
+		require.False(t, limiter.recordFailure("alice", now))
+	}
+	limiter.reset("alice")
+
+	// After a reset (a successful check), the count starts over.
+	for i := 0; i < secondFactorFailureLimit-1; i++ {
+		require.False(t, limiter.recordFailure("alice", now))
+	}
+	require.True(t, limiter.recordFailure("alice", now))
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webauthn implements WebAuthn (FIDO2) registration and
+// authentication ceremonies for Teleport users, backed by the duo-labs
+// webauthn library. It intentionally mirrors the shape of the legacy
+// lib/auth/u2f package so callers in lib/auth can select between the two
+// at runtime.
+package webauthn
+
+import (
+	"context"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+// RegistrationIdentity represents the subset of the Identity service
+// required to carry out WebAuthn registration ceremonies.
+type RegistrationIdentity interface {
+	UpsertWebauthnSessionData(ctx context.Context, user, sessionID string, sd *SessionData) error
+	GetWebauthnSessionData(ctx context.Context, user, sessionID string) (*SessionData, error)
+	DeleteWebauthnSessionData(ctx context.Context, user, sessionID string) error
+	UpsertMFADevice(ctx context.Context, user string, d *types.MFADevice) error
+	GetMFADevices(ctx context.Context, user string, withSecrets bool) ([]*types.MFADevice, error)
+}
+
+// SessionData is the state Teleport must persist between the begin and
+// finish steps of a WebAuthn ceremony (the duo-labs library calls this the
+// "session data").
+type SessionData struct {
+	Challenge        []byte
+	UserID           []byte
+	AllowCredentials [][]byte
+	UserVerification string
+}
+
+// User adapts a Teleport user and its registered WebAuthn devices to the
+// webauthn.User interface required by the duo-labs library.
+type User struct {
+	teleportUser types.User
+	devices      []*types.MFADevice
+}
+
+// NewUser wraps a Teleport user and its WebAuthn devices so they can be
+// passed to the duo-labs webauthn library.
+func NewUser(u types.User, devices []*types.MFADevice) *User {
+	return &User{teleportUser: u, devices: devices}
+}
+
+func (u *User) WebAuthnID() []byte          { return []byte(u.teleportUser.GetName()) }
+func (u *User) WebAuthnName() string        { return u.teleportUser.GetName() }
+func (u *User) WebAuthnDisplayName() string { return u.teleportUser.GetName() }
+func (u *User) WebAuthnIcon() string        { return "" }
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.devices))
+	for _, d := range u.devices {
+		wan := d.GetWebauthn()
+		if wan == nil {
+			continue
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:              wan.CredentialId,
+			PublicKey:       wan.PublicKeyCbor,
+			AttestationType: wan.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    wan.Aaguid,
+				SignCount: wan.SignatureCounter,
+			},
+		})
+	}
+	return creds
+}
+
+// RegistrationFlow implements the "begin"/"finish" steps of WebAuthn
+// credential registration, as used during device enrollment.
+type RegistrationFlow struct {
+	Webauthn *types.Webauthn
+	Identity RegistrationIdentity
+}
+
+// Begin starts the registration ceremony, returning the CredentialCreation
+// options the client must pass to navigator.credentials.create().
+func (f *RegistrationFlow) Begin(ctx context.Context, user types.User) (*protocol.CredentialCreation, error) {
+	web, err := f.newWebAuthn()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	devices, err := f.Identity.GetMFADevices(ctx, user.GetName(), false)
+	if err != nil && !trace.IsNotFound(err) {
+		return nil, trace.Wrap(err)
+	}
+
+	cc, sessData, err := web.BeginRegistration(
+		NewUser(user, devices),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationRequired,
+		}),
+	)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sd := &SessionData{
+		Challenge: []byte(sessData.Challenge),
+		UserID:    sessData.UserID,
+	}
+	if err := f.Identity.UpsertWebauthnSessionData(ctx, user.GetName(), "register", sd); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return cc, nil
+}
+
+// Finish verifies the attestation object returned by the client (supporting
+// the "packed", "fido-u2f" and "none" formats) and, on success, persists the
+// new credential as a types.MFADevice_Webauthn device.
+func (f *RegistrationFlow) Finish(ctx context.Context, user types.User, deviceName string, resp *protocol.ParsedCredentialCreationData) (*types.MFADevice, error) {
+	web, err := f.newWebAuthn()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sd, err := f.Identity.GetWebauthnSessionData(ctx, user.GetName(), "register")
+	if err != nil {
+		return nil, trace.AccessDenied("webauthn registration session not found or expired")
+	}
+	defer f.Identity.DeleteWebauthnSessionData(ctx, user.GetName(), "register")
+
+	cred, err := web.CreateCredential(NewUser(user, nil), webauthn.SessionData{
+		Challenge: string(sd.Challenge),
+		UserID:    sd.UserID,
+	}, resp)
+	if err != nil {
+		return nil, trace.AccessDenied("failed to verify WebAuthn attestation: %v", err)
+	}
+
+	dev := types.NewMFADevice(deviceName, uuid.New().String(), time.Now())
+	dev.Device = &types.MFADevice_Webauthn{
+		Webauthn: &types.WebauthnDevice{
+			CredentialId:     cred.ID,
+			PublicKeyCbor:    cred.PublicKey,
+			AttestationType:  cred.AttestationType,
+			Aaguid:           cred.Authenticator.AAGUID,
+			SignatureCounter: cred.Authenticator.SignCount,
+		},
+	}
+
+	if err := f.Identity.UpsertMFADevice(ctx, user.GetName(), dev); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return dev, nil
+}
+
+// LoginFlow implements the "begin"/"finish" steps of WebAuthn
+// authentication, as used during sign-in and step-up MFA checks.
+type LoginFlow struct {
+	Webauthn *types.Webauthn
+	Identity RegistrationIdentity
+}
+
+// Begin starts the authentication ceremony, returning the
+// CredentialAssertion options the client must pass to
+// navigator.credentials.get().
+func (f *LoginFlow) Begin(ctx context.Context, user types.User) (*protocol.CredentialAssertion, error) {
+	web, err := f.newWebAuthn()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	devices, err := f.Identity.GetMFADevices(ctx, user.GetName(), false)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	assertion, sessData, err := web.BeginLogin(NewUser(user, devices),
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sd := &SessionData{Challenge: []byte(sessData.Challenge), UserID: sessData.UserID}
+	if err := f.Identity.UpsertWebauthnSessionData(ctx, user.GetName(), "login", sd); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return assertion, nil
+}
+
+// Finish verifies the assertion returned by the client, enforcing user
+// verification and RP ID / origin checks, and returns the MFA device used.
+func (f *LoginFlow) Finish(ctx context.Context, user types.User, resp *protocol.ParsedCredentialAssertionData) (*types.MFADevice, error) {
+	web, err := f.newWebAuthn()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	devices, err := f.Identity.GetMFADevices(ctx, user.GetName(), true)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sd, err := f.Identity.GetWebauthnSessionData(ctx, user.GetName(), "login")
+	if err != nil {
+		return nil, trace.AccessDenied("webauthn login session not found or expired")
+	}
+	defer f.Identity.DeleteWebauthnSessionData(ctx, user.GetName(), "login")
+
+	wanUser := NewUser(user, devices)
+	cred, err := web.ValidateLogin(wanUser, webauthn.SessionData{
+		Challenge:        string(sd.Challenge),
+		UserID:           sd.UserID,
+		UserVerification: protocol.VerificationRequired,
+	}, resp)
+	if err != nil {
+		return nil, trace.AccessDenied("failed to verify WebAuthn assertion: %v", err)
+	}
+
+	for _, dev := range devices {
+		wan := dev.GetWebauthn()
+		if wan == nil || string(wan.CredentialId) != string(cred.ID) {
+			continue
+		}
+		wan.SignatureCounter = cred.Authenticator.SignCount
+		dev.LastUsed = time.Now()
+		if err := f.Identity.UpsertMFADevice(ctx, user.GetName(), dev); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return dev, nil
+	}
+	return nil, trace.AccessDenied("credential used for login was not found among registered devices")
+}
+
+// ParseCredentialAssertionResponse parses a raw WebAuthn assertion response.
+// If the response was produced by a legacy U2F key presented under its old
+// AppID, the RP ID the duo-labs library sees is rewritten from the U2F
+// AppID to rpID (the cluster's configured WebAuthn RP ID), so the library's
+// origin/RP ID check accepts it, preserving existing U2F keys after a
+// cluster migrates its second factor to WebAuthn.
+func ParseCredentialAssertionResponse(resp *protocol.CredentialAssertionResponse, u2fAppID, rpID string) (*protocol.ParsedCredentialAssertionData, error) {
+	parsed, err := resp.Parse()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	translateU2FAppID(parsed, u2fAppID, rpID)
+	return parsed, nil
+}
+
+// translateU2FAppID rewrites parsed's RP ID from the U2F AppID to rpID, the
+// cluster's configured WebAuthn RP ID, when the assertion was produced by a
+// legacy U2F key presenting its old AppID as the RP ID. This makes the
+// library's origin/RP ID check accept it as an alias of the real RP ID, so
+// existing U2F registrations keep working after a cluster switches its
+// second factor to WebAuthn.
+func translateU2FAppID(parsed *protocol.ParsedCredentialAssertionData, u2fAppID, rpID string) {
+	if u2fAppID != "" && parsed.Response.RelyingPartyID == u2fAppID {
+		parsed.Response.RelyingPartyID = rpID
+	}
+}
+
+func (f *RegistrationFlow) newWebAuthn() (*webauthn.WebAuthn, error) {
+	return newWebAuthn(f.Webauthn)
+}
+
+func (f *LoginFlow) newWebAuthn() (*webauthn.WebAuthn, error) {
+	return newWebAuthn(f.Webauthn)
+}
+
+func newWebAuthn(cfg *types.Webauthn) (*webauthn.WebAuthn, error) {
+	if cfg == nil || cfg.RPID == "" {
+		return nil, trace.BadParameter("missing webauthn configuration (rp_id)")
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:                  cfg.RPID,
+		RPDisplayName:         cfg.RPDisplayName,
+		RPOrigins:             cfg.RPOrigins,
+		AttestationPreference: protocol.PreferDirectAttestation,
+	})
+}
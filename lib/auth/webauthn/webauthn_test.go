@@ -0,0 +1,68 @@
+// Copyright 2021 Gravitational, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webauthn
+
+import (
+	"testing"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranslateU2FAppID(t *testing.T) {
+	const (
+		u2fAppID = "https://example.com/u2f-app-id.json"
+		rpID     = "example.com"
+	)
+
+	tests := []struct {
+		name   string
+		rpID   string
+		appID  string
+		before string
+		want   string
+	}{
+		{
+			name:   "legacy U2F assertion is translated to the configured RP ID",
+			appID:  u2fAppID,
+			before: u2fAppID,
+			want:   rpID,
+		},
+		{
+			name:   "native WebAuthn assertion is left untouched",
+			appID:  u2fAppID,
+			before: rpID,
+			want:   rpID,
+		},
+		{
+			name:   "no AppID configured leaves the assertion untouched",
+			appID:  "",
+			before: u2fAppID,
+			want:   u2fAppID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := &protocol.ParsedCredentialAssertionData{
+				Response: protocol.ParsedAssertionResponse{
+					RelyingPartyID: tt.before,
+				},
+			}
+			translateU2FAppID(parsed, tt.appID, rpID)
+			require.Equal(t, tt.want, parsed.Response.RelyingPartyID)
+		})
+	}
+}